@@ -0,0 +1,84 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	v1beta1 "istio.io/api/security/v1beta1"
+	"istio.io/istio/pkg/config/labels"
+)
+
+// AuthorizationPolicyConfig is a single AuthorizationPolicy resource together with the
+// namespace/name Pilot tracks it under.
+type AuthorizationPolicyConfig struct {
+	Namespace           string
+	Name                string
+	Annotations         map[string]string
+	AuthorizationPolicy *v1beta1.AuthorizationPolicy
+}
+
+// auditShadowActionAnnotation lets an AUDIT action policy declare which decision (ALLOW or
+// DENY) it shadows, so its rules land in the matching HTTP/TCP filter's ShadowRules. Policies
+// that don't set it default to shadowing DENY, the more conservative choice.
+const auditShadowActionAnnotation = "istio.io/audit-shadows-action"
+
+// AuthorizationPolicies aggregates the AuthorizationPolicy resources configured for the mesh,
+// indexed by namespace for lookup.
+type AuthorizationPolicies struct {
+	NamespaceToPolicies map[string][]AuthorizationPolicyConfig
+	RootNamespace       string
+}
+
+// ListAuthorizationPolicies returns the AuthorizationPolicy resources that select workload in
+// namespace, split by the action they were written for: CUSTOM, DENY, ALLOW, and the two
+// flavors of AUDIT (auditDeny, auditAllow) based on auditShadowActionAnnotation.
+func (policies *AuthorizationPolicies) ListAuthorizationPolicies(namespace string, workload labels.Collection) (
+	custom, deny, allow, auditDeny, auditAllow []AuthorizationPolicyConfig) {
+	if policies == nil {
+		return nil, nil, nil, nil, nil
+	}
+	for _, config := range policies.matchingConfigs(namespace, workload) {
+		switch config.AuthorizationPolicy.GetAction() {
+		case v1beta1.AuthorizationPolicy_CUSTOM:
+			custom = append(custom, config)
+		case v1beta1.AuthorizationPolicy_DENY:
+			deny = append(deny, config)
+		case v1beta1.AuthorizationPolicy_ALLOW:
+			allow = append(allow, config)
+		case v1beta1.AuthorizationPolicy_AUDIT:
+			if config.Annotations[auditShadowActionAnnotation] == "ALLOW" {
+				auditAllow = append(auditAllow, config)
+			} else {
+				auditDeny = append(auditDeny, config)
+			}
+		}
+	}
+	return custom, deny, allow, auditDeny, auditAllow
+}
+
+// matchingConfigs returns every policy configured for namespace, plus the mesh root namespace,
+// whose workload selector matches workload. A policy with no selector applies to every
+// workload in its namespace.
+func (policies *AuthorizationPolicies) matchingConfigs(namespace string, workload labels.Collection) []AuthorizationPolicyConfig {
+	var matched []AuthorizationPolicyConfig
+	for _, ns := range []string{policies.RootNamespace, namespace} {
+		for _, config := range policies.NamespaceToPolicies[ns] {
+			selector := labels.Instance(config.AuthorizationPolicy.GetSelector().GetMatchLabels())
+			if len(selector) == 0 || workload.IsSupersetOf(selector) {
+				matched = append(matched, config)
+			}
+		}
+	}
+	return matched
+}
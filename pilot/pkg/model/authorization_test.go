@@ -0,0 +1,122 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"testing"
+
+	v1beta1 "istio.io/api/security/v1beta1"
+	"istio.io/istio/pkg/config/labels"
+)
+
+func policyConfig(ns, name string, action v1beta1.AuthorizationPolicy_Action, selector map[string]string, annotations map[string]string) AuthorizationPolicyConfig {
+	return AuthorizationPolicyConfig{
+		Namespace:   ns,
+		Name:        name,
+		Annotations: annotations,
+		AuthorizationPolicy: &v1beta1.AuthorizationPolicy{
+			Action:   action,
+			Selector: &v1beta1.WorkloadSelector{MatchLabels: selector},
+		},
+	}
+}
+
+func TestMatchingConfigs(t *testing.T) {
+	policies := &AuthorizationPolicies{
+		RootNamespace: "istio-system",
+		NamespaceToPolicies: map[string][]AuthorizationPolicyConfig{
+			"istio-system": {
+				policyConfig("istio-system", "mesh-wide", v1beta1.AuthorizationPolicy_DENY, nil, nil),
+			},
+			"default": {
+				policyConfig("default", "no-selector", v1beta1.AuthorizationPolicy_ALLOW, nil, nil),
+				policyConfig("default", "matches", v1beta1.AuthorizationPolicy_ALLOW, map[string]string{"app": "httpbin"}, nil),
+				policyConfig("default", "doesnt-match", v1beta1.AuthorizationPolicy_ALLOW, map[string]string{"app": "sleep"}, nil),
+			},
+			"other": {
+				policyConfig("other", "different-namespace", v1beta1.AuthorizationPolicy_ALLOW, nil, nil),
+			},
+		},
+	}
+
+	workload := labels.Collection{{"app": "httpbin"}}
+	matched := policies.matchingConfigs("default", workload)
+
+	var names []string
+	for _, config := range matched {
+		names = append(names, config.Name)
+	}
+	want := []string{"mesh-wide", "no-selector", "matches"}
+	if len(names) != len(want) {
+		t.Fatalf("matchingConfigs() = %v, want %v", names, want)
+	}
+	for i, name := range want {
+		if names[i] != name {
+			t.Errorf("matchingConfigs()[%d] = %q, want %q", i, names[i], name)
+		}
+	}
+}
+
+func TestListAuthorizationPolicies(t *testing.T) {
+	var nilPolicies *AuthorizationPolicies
+	custom, deny, allow, auditDeny, auditAllow := nilPolicies.ListAuthorizationPolicies("default", nil)
+	if custom != nil || deny != nil || allow != nil || auditDeny != nil || auditAllow != nil {
+		t.Fatal("ListAuthorizationPolicies on a nil *AuthorizationPolicies should return all-nil")
+	}
+
+	policies := &AuthorizationPolicies{
+		NamespaceToPolicies: map[string][]AuthorizationPolicyConfig{
+			"default": {
+				policyConfig("default", "custom", v1beta1.AuthorizationPolicy_CUSTOM, nil, nil),
+				policyConfig("default", "deny", v1beta1.AuthorizationPolicy_DENY, nil, nil),
+				policyConfig("default", "allow", v1beta1.AuthorizationPolicy_ALLOW, nil, nil),
+				policyConfig("default", "audit-default", v1beta1.AuthorizationPolicy_AUDIT, nil, nil),
+				policyConfig("default", "audit-allow", v1beta1.AuthorizationPolicy_AUDIT, nil,
+					map[string]string{auditShadowActionAnnotation: "ALLOW"}),
+				policyConfig("default", "audit-deny", v1beta1.AuthorizationPolicy_AUDIT, nil,
+					map[string]string{auditShadowActionAnnotation: "DENY"}),
+			},
+		},
+	}
+
+	custom, deny, allow, auditDeny, auditAllow = policies.ListAuthorizationPolicies("default", nil)
+	if len(custom) != 1 || custom[0].Name != "custom" {
+		t.Errorf("custom = %v, want [custom]", custom)
+	}
+	if len(deny) != 1 || deny[0].Name != "deny" {
+		t.Errorf("deny = %v, want [deny]", deny)
+	}
+	if len(allow) != 1 || allow[0].Name != "allow" {
+		t.Errorf("allow = %v, want [allow]", allow)
+	}
+	// An AUDIT policy with no auditShadowActionAnnotation, or an explicit "DENY" value, must be
+	// categorized as auditDeny: the annotation's documented default is the conservative choice.
+	var auditDenyNames []string
+	for _, config := range auditDeny {
+		auditDenyNames = append(auditDenyNames, config.Name)
+	}
+	wantAuditDeny := []string{"audit-default", "audit-deny"}
+	if len(auditDenyNames) != len(wantAuditDeny) {
+		t.Fatalf("auditDeny = %v, want %v", auditDenyNames, wantAuditDeny)
+	}
+	for i, name := range wantAuditDeny {
+		if auditDenyNames[i] != name {
+			t.Errorf("auditDeny[%d] = %q, want %q", i, auditDenyNames[i], name)
+		}
+	}
+	if len(auditAllow) != 1 || auditAllow[0].Name != "audit-allow" {
+		t.Errorf("auditAllow = %v, want [audit-allow]", auditAllow)
+	}
+}
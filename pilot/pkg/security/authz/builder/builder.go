@@ -16,7 +16,9 @@ package builder
 
 import (
 	"fmt"
+	"sort"
 
+	meshconfig "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/util"
 	authzmodel "istio.io/istio/pilot/pkg/security/authz/model"
@@ -24,11 +26,17 @@ import (
 	"istio.io/istio/pkg/config/labels"
 	"istio.io/pkg/log"
 
+	corepb "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	tcppb "github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
 	rbachttppb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rbac/v2"
 	httppb "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
 	rbactcppb "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/rbac/v2"
 	rbacpb "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v2"
+	matcherpb "github.com/envoyproxy/go-control-plane/envoy/type/matcher"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+
+	extauthzhttppb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/ext_authz/v2"
+	extauthztcppb "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/ext_authz/v2"
 )
 
 var (
@@ -37,71 +45,436 @@ var (
 
 // Builder builds Istio authorization policy to Envoy RBAC filter.
 type Builder struct {
-	trustDomainBundle trustdomain.Bundle
-	denyPolicies      []model.AuthorizationPolicyConfig
-	allowPolicies     []model.AuthorizationPolicyConfig
+	trustDomainBundle  trustdomain.Bundle
+	customPolicies     []model.AuthorizationPolicyConfig
+	denyPolicies       []model.AuthorizationPolicyConfig
+	allowPolicies      []model.AuthorizationPolicyConfig
+	auditDenyPolicies  []model.AuthorizationPolicyConfig
+	auditAllowPolicies []model.AuthorizationPolicyConfig
+
+	// extAuthzProviders holds the mesh-configured extension providers, keyed by name, that
+	// a CUSTOM action policy may reference to reach an external authorizer.
+	extAuthzProviders map[string]*meshconfig.MeshConfig_ExtensionProvider
+
+	// auditLoggingOptions configures the pluggable RBAC audit loggers attached to every
+	// generated RBAC filter. Nil means audit logging is left to Envoy's defaults.
+	auditLoggingOptions *AuditLoggingOptions
+
+	// effectivePolicyID, if set, makes every generated RBAC filter track and expose the
+	// matched policy's ID via Envoy's per-rule stats and dynamic metadata.
+	effectivePolicyID *EffectivePolicyIDOption
+}
+
+// Option bundles the New inputs that come from mesh-wide configuration rather than from the
+// workload's own AuthorizationPolicy resources.
+type Option struct {
+	// ExtAuthzProviders holds the mesh-configured extension providers, keyed by name, that a
+	// CUSTOM action policy may reference to reach an external authorizer.
+	ExtAuthzProviders map[string]*meshconfig.MeshConfig_ExtensionProvider
+	// AuditLogging configures the RBAC audit loggers attached to every generated RBAC filter.
+	// Nil leaves audit logging unset.
+	AuditLogging *AuditLoggingOptions
+	// EffectivePolicyID, if set, enables per-rule stats/dynamic-metadata so the policy that
+	// matched a request can be correlated with its access log entry. Nil leaves it disabled.
+	EffectivePolicyID *EffectivePolicyIDOption
+}
+
+// EffectivePolicyIDOption enables Envoy's per-rule RBAC stats and dynamic metadata for this
+// Builder's filters. The namespace and key access logging reads the matched policy's ID from
+// are fixed by Envoy itself - the RBAC filter's own name and authzmodel.ShadowEffectivePolicyIDKey
+// - not configurable here, so there is nothing for this option to carry beyond on/off.
+//
+// Enabling this on a workload that also has a CUSTOM action policy is safe only because every
+// CUSTOM provider's HTTP shadow gate has a name of its own: the enforced DENY/ALLOW filters share
+// authzmodel.RBACHTTPFilterName, while each CUSTOM provider's shadow gate uses its own
+// customRBACFilterName (see buildCustomHTTP). TrackPerRuleStats writes dynamic metadata into the
+// namespace of the filter that set it, so a DENY/ALLOW filter populating
+// ShadowEffectivePolicyIDKey under its own name can never satisfy createExtAuthzHTTPFilter's
+// FilterEnabledMetadata match, which is scoped to one specific provider's customRBACFilterName.
+// Before that per-provider naming existed, every RBAC filter shared authzmodel.RBACHTTPFilterName,
+// so turning this option on for an ordinary DENY/ALLOW filter would have made its matches look
+// indistinguishable, in that shared namespace, from a CUSTOM provider's own shadow match - sending
+// unrelated traffic through ext_authz.
+type EffectivePolicyIDOption struct{}
+
+// AuditLoggerConfig describes a single pluggable Envoy RBAC audit logger.
+type AuditLoggerConfig struct {
+	// Name is the audit logger extension Envoy should load, e.g. "envoy.rbac.stdout_logger".
+	Name string
+	// Config is the logger's opaque, logger-specific configuration.
+	Config *structpb.Struct
+	// IsOptional mirrors the TypedExtensionConfig field of the same name: if true, a logger
+	// that can't be resolved is silently skipped instead of failing the listener.
+	IsOptional bool
+}
+
+// AuditLoggingOptions configures the RBAC audit loggers attached to every RBAC filter the
+// Builder generates, and the condition under which they fire.
+type AuditLoggingOptions struct {
+	Loggers []AuditLoggerConfig
+	// Condition is one of NONE, ON_DENY, ON_ALLOW, ON_DENY_AND_ALLOW.
+	Condition string
 }
 
-// New returns a new builder for the given workload with the authorization policy.
+// New returns a new builder for the given workload with the authorization policy. opt carries
+// the mesh-wide configuration (ext_authz providers, audit logging, effective-policy-id) that
+// applies to every filter the Builder generates.
 // Returns nil if none of the authorization policies are enabled for the workload.
 func New(trustDomainBundle trustdomain.Bundle, workload labels.Collection, namespace string,
-	policies *model.AuthorizationPolicies) *Builder {
-	denyPolicies, allowPolicies := policies.ListAuthorizationPolicies(namespace, workload)
-	if len(denyPolicies) == 0 && len(allowPolicies) == 0 {
+	policies *model.AuthorizationPolicies, opt Option) *Builder {
+	customPolicies, denyPolicies, allowPolicies, auditDenyPolicies, auditAllowPolicies :=
+		policies.ListAuthorizationPolicies(namespace, workload)
+	if len(customPolicies) == 0 && len(denyPolicies) == 0 && len(allowPolicies) == 0 &&
+		len(auditDenyPolicies) == 0 && len(auditAllowPolicies) == 0 {
 		return nil
 	}
 	return &Builder{
-		trustDomainBundle: trustDomainBundle,
-		denyPolicies:      denyPolicies,
-		allowPolicies:     allowPolicies,
+		trustDomainBundle:   trustDomainBundle,
+		customPolicies:      customPolicies,
+		denyPolicies:        denyPolicies,
+		allowPolicies:       allowPolicies,
+		auditDenyPolicies:   auditDenyPolicies,
+		auditAllowPolicies:  auditAllowPolicies,
+		extAuthzProviders:   opt.ExtAuthzProviders,
+		auditLoggingOptions: opt.AuditLogging,
+		effectivePolicyID:   opt.EffectivePolicyID,
 	}
 }
 
 // BuilderHTTP returns the RBAC HTTP filters built from the authorization policy.
-func (b Builder) BuildHTTP() []*httppb.HttpFilter {
+func (b Builder) BuildHTTP() ([]*httppb.HttpFilter, error) {
+	auditLogging, err := buildAuditLoggingOptions(b.auditLoggingOptions)
+	if err != nil {
+		return nil, err
+	}
+
 	var filters []*httppb.HttpFilter
 
-	if denyConfig := build(b.denyPolicies, b.trustDomainBundle,
-		false /* forTCP */, true /* forDeny */); denyConfig != nil {
-		filters = append(filters, createHTTPFilter(denyConfig))
+	customFilters, customDeny, customDenyDryRun := b.buildCustomHTTP(auditLogging)
+
+	denyRules, denyDryRun := buildRBACRules(b.denyPolicies, b.trustDomainBundle, false /* forTCP */, rbacpb.RBAC_DENY)
+	auditDenyRules, _ := buildRBACRules(b.auditDenyPolicies, b.trustDomainBundle, false /* forTCP */, rbacpb.RBAC_DENY)
+	denyRules = mergePolicySets(denyRules, customDeny)
+	if config := mergeRBAC(denyRules, mergePolicySets(denyDryRun, auditDenyRules, customDenyDryRun)); config != nil {
+		attachAuditLogging(config, auditLogging)
+		applyEffectivePolicyID(config, b.effectivePolicyID)
+		filters = append(filters, createHTTPFilter(authzmodel.RBACHTTPFilterName, config))
 	}
-	if allowConfig := build(b.allowPolicies, b.trustDomainBundle,
-		false /* forTCP */, false /* forDeny */); allowConfig != nil {
-		filters = append(filters, createHTTPFilter(allowConfig))
+
+	filters = append(filters, customFilters...)
+
+	allowRules, allowDryRun := buildRBACRules(b.allowPolicies, b.trustDomainBundle, false /* forTCP */, rbacpb.RBAC_ALLOW)
+	auditAllowRules, _ := buildRBACRules(b.auditAllowPolicies, b.trustDomainBundle, false /* forTCP */, rbacpb.RBAC_ALLOW)
+	if config := mergeRBAC(allowRules, mergePolicySets(allowDryRun, auditAllowRules)); config != nil {
+		attachAuditLogging(config, auditLogging)
+		applyEffectivePolicyID(config, b.effectivePolicyID)
+		filters = append(filters, createHTTPFilter(authzmodel.RBACHTTPFilterName, config))
 	}
 
-	return filters
+	return filters, nil
 }
 
 // BuildTCP returns the RBAC TCP filters built from the authorization policy.
-func (b Builder) BuildTCP() []*tcppb.Filter {
+func (b Builder) BuildTCP() ([]*tcppb.Filter, error) {
+	auditLogging, err := buildAuditLoggingOptions(b.auditLoggingOptions)
+	if err != nil {
+		return nil, err
+	}
+
 	var filters []*tcppb.Filter
 
-	if denyConfig := build(b.denyPolicies, b.trustDomainBundle,
-		true /* forTCP */, true /* forDeny */); denyConfig != nil {
-		filters = append(filters, createTCPFilter(denyConfig))
+	customFilters, customDeny, customDenyDryRun := b.buildCustomTCP(auditLogging)
+
+	denyRules, denyDryRun := buildRBACRules(b.denyPolicies, b.trustDomainBundle, true /* forTCP */, rbacpb.RBAC_DENY)
+	auditDenyRules, _ := buildRBACRules(b.auditDenyPolicies, b.trustDomainBundle, true /* forTCP */, rbacpb.RBAC_DENY)
+	denyRules = mergePolicySets(denyRules, customDeny)
+	if config := mergeRBAC(denyRules, mergePolicySets(denyDryRun, auditDenyRules, customDenyDryRun)); config != nil {
+		attachAuditLogging(config, auditLogging)
+		applyEffectivePolicyID(config, b.effectivePolicyID)
+		filters = append(filters, createTCPFilter(config))
 	}
-	if allowConfig := build(b.allowPolicies, b.trustDomainBundle,
-		true /* forTCP */, false /* forDeny */); allowConfig != nil {
-		filters = append(filters, createTCPFilter(allowConfig))
+
+	filters = append(filters, customFilters...)
+
+	allowRules, allowDryRun := buildRBACRules(b.allowPolicies, b.trustDomainBundle, true /* forTCP */, rbacpb.RBAC_ALLOW)
+	auditAllowRules, _ := buildRBACRules(b.auditAllowPolicies, b.trustDomainBundle, true /* forTCP */, rbacpb.RBAC_ALLOW)
+	if config := mergeRBAC(allowRules, mergePolicySets(allowDryRun, auditAllowRules)); config != nil {
+		attachAuditLogging(config, auditLogging)
+		applyEffectivePolicyID(config, b.effectivePolicyID)
+		filters = append(filters, createTCPFilter(config))
 	}
 
-	return filters
+	return filters, nil
 }
 
-func build(policies []model.AuthorizationPolicyConfig, tdBundle trustdomain.Bundle, forTCP, forDeny bool) *rbachttppb.RBAC {
-	if len(policies) == 0 {
-		return nil
+// buildAuditLoggingOptions translates AuditLoggingOptions into the Envoy RBAC proto. Returns
+// nil if opts is nil or declares no loggers. A logger with no config that isn't marked
+// optional is treated as a typo'd or unresolved reference: rather than silently dropping it,
+// the build fails so the misconfiguration is caught before it reaches Envoy.
+func buildAuditLoggingOptions(opts *AuditLoggingOptions) (*rbacpb.RBAC_AuditLoggingOptions, error) {
+	if opts == nil || len(opts.Loggers) == 0 {
+		return nil, nil
 	}
 
-	rules := &rbacpb.RBAC{
-		Action:   rbacpb.RBAC_ALLOW,
-		Policies: map[string]*rbacpb.Policy{},
+	condition, err := parseAuditCondition(opts.Condition)
+	if err != nil {
+		return nil, err
 	}
-	if forDeny {
-		rules.Action = rbacpb.RBAC_DENY
+
+	pb := &rbacpb.RBAC_AuditLoggingOptions{AuditCondition: condition}
+	for _, logger := range opts.Loggers {
+		if logger.Config == nil && !logger.IsOptional {
+			return nil, fmt.Errorf("audit logger %q has no config and is not marked optional", logger.Name)
+		}
+		if logger.Config == nil {
+			authzLog.Errorf("skipped optional audit logger %q: no config found", logger.Name)
+			continue
+		}
+		pb.LoggerConfigs = append(pb.LoggerConfigs, &rbacpb.RBAC_AuditLoggingOptions_AuditLoggerConfig{
+			AuditLogger: &corepb.TypedExtensionConfig{
+				Name:        logger.Name,
+				TypedConfig: util.MessageToAny(logger.Config),
+			},
+			IsOptional: logger.IsOptional,
+		})
+	}
+	return pb, nil
+}
+
+// parseAuditCondition translates the audit condition string from mesh config into the
+// matching Envoy enum value.
+func parseAuditCondition(condition string) (rbacpb.RBAC_AuditLoggingOptions_AuditCondition, error) {
+	if condition == "" {
+		return rbacpb.RBAC_AuditLoggingOptions_NONE, nil
 	}
+	if parsed, ok := rbacpb.RBAC_AuditLoggingOptions_AuditCondition_value[condition]; ok {
+		return rbacpb.RBAC_AuditLoggingOptions_AuditCondition(parsed), nil
+	}
+	return rbacpb.RBAC_AuditLoggingOptions_NONE, fmt.Errorf("invalid audit condition %q", condition)
+}
+
+// attachAuditLogging sets options on every rbacpb.RBAC (enforce and shadow) carried by config.
+func attachAuditLogging(config *rbachttppb.RBAC, options *rbacpb.RBAC_AuditLoggingOptions) {
+	if config == nil || options == nil {
+		return
+	}
+	if config.Rules != nil {
+		config.Rules.AuditLoggingOptions = options
+	}
+	if config.ShadowRules != nil {
+		config.ShadowRules.AuditLoggingOptions = options
+	}
+}
+
+// applyEffectivePolicyID turns on Envoy's per-rule RBAC stats and dynamic metadata for every
+// rbacpb.RBAC (enforce and shadow) carried by config. Once enabled, Envoy stamps the name of
+// the policy that matched a request - the same ns[...]-policy[...]-rule[...] name used as the
+// map key in buildRBACRules() and buildCustomRules() - into dynamic metadata and into the RBAC stat_prefix dimensions, so it
+// can be correlated with the request's access log entry.
+func applyEffectivePolicyID(config *rbachttppb.RBAC, opt *EffectivePolicyIDOption) {
+	if config == nil || opt == nil {
+		return
+	}
+	if config.Rules != nil {
+		config.Rules.TrackPerRuleStats = true
+	}
+	if config.ShadowRules != nil {
+		config.ShadowRules.TrackPerRuleStats = true
+	}
+}
+
+// buildCustomRules splits the CUSTOM action policies into, per referenced provider, the rules
+// that should gate that provider's ext_authz filter, plus a DENY ruleset for policies whose
+// provider can't be resolved, itself split into enforced and dry-run like buildRBACRules. It is
+// shared by buildCustomHTTP and buildCustomTCP, which only differ in the Envoy filter types they
+// wrap the result in.
+//
+// Each provider's ruleset is returned as an RBAC ALLOW block, but it is only ever installed as
+// ShadowRules (see buildCustomHTTP/buildCustomTCP), never as the enforced Rules: a CUSTOM
+// policy's job is to decide whether ext_authz runs, not to allow or deny the request itself, so
+// unmatched traffic must fall through to the mesh's ordinary deny/allow filters unaffected
+// rather than being rejected by the gate. A policy with an unresolvable provider can't gate
+// anything, so instead it contributes a real, narrowly-scoped DENY rule for exactly the
+// traffic it covers - failing closed without touching any other traffic on the workload - unless
+// the policy carries the dry-run annotation, in which case that DENY rule is shadow-only too, so
+// dry-run is honored the same way here as it is for ordinary DENY/ALLOW policies.
+func (b Builder) buildCustomRules(forTCP bool) (perProvider map[string]*rbacpb.RBAC, badProviderDeny, badProviderDenyDryRun *rbacpb.RBAC) {
+	for _, policy := range b.customPolicies {
+		provider := policy.AuthorizationPolicy.GetProvider().GetName()
+		ext, found := b.extAuthzProviders[provider]
+		badProvider := provider == "" || !found || !isExtAuthzProvider(ext)
+		dryRunPolicy := isDryRun(policy)
+
+		for i, rule := range policy.AuthorizationPolicy.Rules {
+			name := fmt.Sprintf("ns[%s]-policy[%s]-rule[%d]", policy.Namespace, policy.Name, i)
+			if rule == nil {
+				authzLog.Errorf("skipped nil rule %s", name)
+				continue
+			}
+			m, err := authzmodel.New(rule)
+			if err != nil {
+				authzLog.Errorf("skipped rule %s: %v", name, err)
+				continue
+			}
+			m.MigrateTrustDomain(b.trustDomainBundle)
+
+			if badProvider {
+				authzLog.Errorf("ns[%s]-policy[%s] references unknown CUSTOM provider %q, denying its traffic",
+					policy.Namespace, policy.Name, provider)
+				generated, err := m.Generate(forTCP, true /* forDeny */)
+				if err != nil {
+					authzLog.Errorf("skipped rule %s: %v", name, err)
+					continue
+				}
+				if generated == nil {
+					continue
+				}
+				if dryRunPolicy {
+					if badProviderDenyDryRun == nil {
+						badProviderDenyDryRun = &rbacpb.RBAC{Action: rbacpb.RBAC_DENY, Policies: map[string]*rbacpb.Policy{}}
+					}
+					badProviderDenyDryRun.Policies[name+"-dry-run"] = generated
+				} else {
+					if badProviderDeny == nil {
+						badProviderDeny = &rbacpb.RBAC{Action: rbacpb.RBAC_DENY, Policies: map[string]*rbacpb.Policy{}}
+					}
+					badProviderDeny.Policies[name] = generated
+				}
+				continue
+			}
+
+			generated, err := m.Generate(forTCP, false /* forDeny */)
+			if err != nil {
+				authzLog.Errorf("skipped rule %s: %v", name, err)
+				continue
+			}
+			if generated == nil {
+				continue
+			}
+			if perProvider == nil {
+				perProvider = map[string]*rbacpb.RBAC{}
+			}
+			if perProvider[provider] == nil {
+				perProvider[provider] = &rbacpb.RBAC{Action: rbacpb.RBAC_ALLOW, Policies: map[string]*rbacpb.Policy{}}
+			}
+			perProvider[provider].Policies[name] = generated
+		}
+	}
+	return perProvider, badProviderDeny, badProviderDenyDryRun
+}
+
+// buildCustomHTTP builds, for each ext_authz provider referenced by a CUSTOM action policy, a
+// shadow-only RBAC filter scoped to that provider's matched rules followed by that provider's
+// ext_authz filter, gated on the shadow match via FilterEnabledMetadata. Since the RBAC filter
+// only ever sets ShadowRules here, it never allows or denies the request itself - it only
+// decides whether the following ext_authz filter runs. badProviderDeny and badProviderDenyDryRun
+// are returned separately so the caller can fold them into the workload's enforced and shadow
+// DENY rules respectively.
+func (b Builder) buildCustomHTTP(auditLogging *rbacpb.RBAC_AuditLoggingOptions) ([]*httppb.HttpFilter, *rbacpb.RBAC, *rbacpb.RBAC) {
+	perProvider, badProviderDeny, badProviderDenyDryRun := b.buildCustomRules(false /* forTCP */)
+
+	var filters []*httppb.HttpFilter
+	for _, provider := range sortedProviderNames(perProvider) {
+		shadow := perProvider[provider]
+		shadow.AuditLoggingOptions = auditLogging
+		// TrackPerRuleStats must always be on here, regardless of b.effectivePolicyID: it's what
+		// makes Envoy populate ShadowEffectivePolicyIDKey in dynamic metadata, which is the gate
+		// createExtAuthzHTTPFilter's FilterEnabledMetadata matches on. Without it the ext_authz
+		// filter below would never fire, CUSTOM policy or not.
+		shadow.TrackPerRuleStats = true
+		// Every provider's shadow RBAC filter gets its own name (rather than the shared
+		// authzmodel.RBACHTTPFilterName every enforced DENY/ALLOW filter uses) so its dynamic
+		// metadata lands in its own namespace: createExtAuthzHTTPFilter below gates strictly on
+		// that namespace, instead of on "some filter anywhere in the chain populated this key" -
+		// which a second CUSTOM provider, or a DENY/ALLOW filter with EffectivePolicyIDOption
+		// enabled, would also satisfy, sending traffic that never matched this provider's rule
+		// to its ext_authz service anyway.
+		filterName := customRBACFilterName(provider)
+		config := &rbachttppb.RBAC{ShadowRules: shadow, ShadowRulesStatPrefix: authzmodel.RBACShadowRulesStatPrefix}
+		filters = append(filters, createHTTPFilter(filterName, config), createExtAuthzHTTPFilter(b.extAuthzProviders[provider], filterName))
+	}
+	return filters, badProviderDeny, badProviderDenyDryRun
+}
+
+// customRBACFilterName returns the distinguishable name for a CUSTOM action's per-provider
+// shadow RBAC filter. See the comment in buildCustomHTTP for why this can't be the shared
+// authzmodel.RBACHTTPFilterName every other RBAC filter in this package uses.
+func customRBACFilterName(provider string) string {
+	return authzmodel.RBACHTTPFilterName + ".custom." + provider
+}
+
+// sortedProviderNames returns perProvider's keys in sorted order, so buildCustomHTTP and
+// buildCustomTCP emit filters in a deterministic order instead of Go's randomized map
+// iteration - which would otherwise reorder the generated filter chain, and so the xDS config
+// pushed to proxies, on every recomputation even when nothing actually changed.
+func sortedProviderNames(perProvider map[string]*rbacpb.RBAC) []string {
+	names := make([]string, 0, len(perProvider))
+	for provider := range perProvider {
+		names = append(names, provider)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// buildCustomTCP is the network-filter equivalent of buildCustomHTTP. Envoy's network ext_authz
+// filter has no per-request equivalent of FilterEnabledMetadata - it authorizes the whole
+// connection - so at this layer a provider's ext_authz filter is chained unconditionally
+// whenever a CUSTOM policy resolves to it: every connection on the filter chain goes through
+// that provider's ext_authz check, not just ones matching the policy's rule, and a second CUSTOM
+// policy referencing a second provider adds a second unconditional check per connection. That's
+// a materially broader and costlier authorization surface than the per-request HTTP gate gets
+// for the same feature, so it's surfaced as a warning log - rather than left as a comment only an
+// engineer reading this file would see - to every operator who attaches a CUSTOM policy to a TCP
+// listener. The shadow RBAC filter is still installed ahead of it, under the shared
+// authzmodel.RBACTCPFilterName; unlike over HTTP, its TrackPerRuleStats is turned on only when
+// EffectivePolicyIDOption is set.
+func (b Builder) buildCustomTCP(auditLogging *rbacpb.RBAC_AuditLoggingOptions) ([]*tcppb.Filter, *rbacpb.RBAC, *rbacpb.RBAC) {
+	perProvider, badProviderDeny, badProviderDenyDryRun := b.buildCustomRules(true /* forTCP */)
+
+	var filters []*tcppb.Filter
+	for _, provider := range sortedProviderNames(perProvider) {
+		shadow := perProvider[provider]
+		authzLog.Warnf("CUSTOM provider %q is chained unconditionally on this TCP listener: "+
+			"every connection is sent through its ext_authz check, not just ones matching the policy's rule", provider)
+		shadow.AuditLoggingOptions = auditLogging
+		if b.effectivePolicyID != nil {
+			shadow.TrackPerRuleStats = true
+		}
+		config := &rbachttppb.RBAC{ShadowRules: shadow, ShadowRulesStatPrefix: authzmodel.RBACShadowRulesStatPrefix}
+		filters = append(filters, createTCPFilter(config), createExtAuthzTCPFilter(b.extAuthzProviders[provider]))
+	}
+	return filters, badProviderDeny, badProviderDenyDryRun
+}
+
+func isExtAuthzProvider(provider *meshconfig.MeshConfig_ExtensionProvider) bool {
+	return provider.GetEnvoyExtAuthzHttp() != nil || provider.GetEnvoyExtAuthzGrpc() != nil
+}
+
+// dryRunAnnotation lets an individual AuthorizationPolicy opt into dry-run mode: its rules
+// are generated and matched as usual, but placed in ShadowRules instead of Rules, so they
+// never actually allow or deny traffic.
+const dryRunAnnotation = "istio.io/dry-run"
+
+// isDryRun reports whether policy carries the dry-run annotation.
+func isDryRun(policy model.AuthorizationPolicyConfig) bool {
+	return policy.Annotations[dryRunAnnotation] == "true"
+}
+
+// buildRBACRules translates policies into Envoy RBAC rulesets with the given action, split
+// into the enforced ruleset and the dry-run ruleset (from policies carrying the
+// dryRunAnnotation). Either return value is nil if it ended up with no policies, so callers
+// can tell "no rules of this kind" apart from "rules that matched nothing". Dry-run policy
+// IDs get a "-dry-run" suffix so operators can tell enforced and dry-run rules apart when
+// correlating access logs with a specific rule.
+func buildRBACRules(policies []model.AuthorizationPolicyConfig, tdBundle trustdomain.Bundle,
+	forTCP bool, action rbacpb.RBAC_Action) (enforce, dryRun *rbacpb.RBAC) {
+	if len(policies) == 0 {
+		return nil, nil
+	}
+
+	forDeny := action == rbacpb.RBAC_DENY
 	for _, policy := range policies {
+		dryRunPolicy := isDryRun(policy)
 		for i, rule := range policy.AuthorizationPolicy.Rules {
 			name := fmt.Sprintf("ns[%s]-policy[%s]-rule[%d]", policy.Namespace, policy.Name, i)
 			if rule == nil {
@@ -119,23 +492,82 @@ func build(policies []model.AuthorizationPolicyConfig, tdBundle trustdomain.Bund
 				authzLog.Errorf("skipped rule %s: %v", name, err)
 				continue
 			}
-			if generated != nil {
-				rules.Policies[name] = generated
-				authzLog.Debugf("rule %s generated policy: %+v", name, generated)
+			if generated == nil {
+				continue
+			}
+			authzLog.Debugf("rule %s generated policy: %+v", name, generated)
+			if dryRunPolicy {
+				if dryRun == nil {
+					dryRun = &rbacpb.RBAC{Action: action, Policies: map[string]*rbacpb.Policy{}}
+				}
+				dryRun.Policies[name+"-dry-run"] = generated
+			} else {
+				if enforce == nil {
+					enforce = &rbacpb.RBAC{Action: action, Policies: map[string]*rbacpb.Policy{}}
+				}
+				enforce.Policies[name] = generated
 			}
 		}
 	}
 
-	return &rbachttppb.RBAC{Rules: rules}
+	return enforce, dryRun
+}
+
+// mergePolicySets unions the Policies maps of any number of same-purpose RBAC rulesets (e.g.
+// shadow rulesets from a dedicated AUDIT policy category and per-policy dry-run annotations, or
+// an enforced DENY ruleset and the DENY rules contributed by a misconfigured CUSTOM policy)
+// into one. nil inputs are ignored; returns nil if every input was nil.
+func mergePolicySets(sets ...*rbacpb.RBAC) *rbacpb.RBAC {
+	var merged *rbacpb.RBAC
+	for _, set := range sets {
+		if set == nil {
+			continue
+		}
+		if merged == nil {
+			merged = &rbacpb.RBAC{Action: set.Action, Policies: map[string]*rbacpb.Policy{}}
+		}
+		for name, policy := range set.Policies {
+			merged.Policies[name] = policy
+		}
+	}
+	return merged
+}
+
+// mergeRBAC combines an enforced ruleset and its shadow counterpart into the RBAC filter
+// config. Shadow rules are exported as ShadowRules so Envoy records whether they matched, via
+// dynamic metadata under the istio_dry_run_ stat prefix, without affecting the enforce
+// decision. Returns nil if both enforce and shadow are nil.
+//
+// Leaving Rules unset when enforce is nil (the audit-only case: a workload with only AUDIT
+// policies and no enforced DENY/ALLOW) is intentional, not an oversight: Envoy's RBAC HTTP/TCP
+// filters treat rules as optional and run in audit-only mode - evaluating and recording
+// ShadowRules matches without enforcing anything - when it's omitted. That's the documented
+// mechanism operators use to roll out a policy in shadow mode before enforcing it, so an
+// RBAC-only-from-AUDIT-policies filter needs the same shape, not a synthesized empty Rules
+// block (an empty ALLOW Policies map denies everything, and an empty DENY Policies map allows
+// everything - neither is "no enforced rule", so leaving Rules nil is the only option that
+// doesn't change behavior).
+func mergeRBAC(enforce, shadow *rbacpb.RBAC) *rbachttppb.RBAC {
+	if enforce == nil && shadow == nil {
+		return nil
+	}
+	config := &rbachttppb.RBAC{Rules: enforce}
+	if shadow != nil {
+		config.ShadowRules = shadow
+		config.ShadowRulesStatPrefix = authzmodel.RBACShadowRulesStatPrefix
+	}
+	return config
 }
 
-// nolint: interfacer
-func createHTTPFilter(config *rbachttppb.RBAC) *httppb.HttpFilter {
+// createHTTPFilter wraps config in an HTTP filter under name. Every enforced DENY/ALLOW filter
+// uses the shared authzmodel.RBACHTTPFilterName; each CUSTOM provider's shadow gate uses its own
+// customRBACFilterName instead, so its dynamic metadata doesn't collide with anyone else's.
+func createHTTPFilter(name string, config *rbachttppb.RBAC) *httppb.HttpFilter {
 	if config == nil {
 		return nil
 	}
 	return &httppb.HttpFilter{
-		Name:       authzmodel.RBACHTTPFilterName,
+		Name:       name,
 		ConfigType: &httppb.HttpFilter_TypedConfig{TypedConfig: util.MessageToAny(config)},
 	}
 }
@@ -145,11 +577,75 @@ func createTCPFilter(config *rbachttppb.RBAC) *tcppb.Filter {
 		return nil
 	}
 	rbacConfig := &rbactcppb.RBAC{
-		Rules:      config.Rules,
-		StatPrefix: authzmodel.RBACTCPFilterStatPrefix,
+		Rules:                 config.Rules,
+		ShadowRules:           config.ShadowRules,
+		StatPrefix:            authzmodel.RBACTCPFilterStatPrefix,
+		ShadowRulesStatPrefix: config.ShadowRulesStatPrefix,
 	}
 	return &tcppb.Filter{
 		Name:       authzmodel.RBACTCPFilterName,
 		ConfigType: &tcppb.Filter_TypedConfig{TypedConfig: util.MessageToAny(rbacConfig)},
 	}
 }
+
+// createExtAuthzHTTPFilter builds the envoy.filters.http.ext_authz filter for the given
+// provider. It is always chained immediately after that provider's shadow RBAC filter - named
+// rbacFilterName, which must be that filter's own customRBACFilterName rather than the shared
+// authzmodel.RBACHTTPFilterName - and FilterEnabledMetadata gates it on that specific filter's
+// shadow match: requests the shadow RBAC didn't match skip ext_authz entirely instead of being
+// denied, and a match recorded under any other filter's namespace (another provider's gate, or a
+// DENY/ALLOW filter with EffectivePolicyIDOption enabled) doesn't satisfy this match either.
+func createExtAuthzHTTPFilter(provider *meshconfig.MeshConfig_ExtensionProvider, rbacFilterName string) *httppb.HttpFilter {
+	config := &extauthzhttppb.ExtAuthz{
+		FailureModeAllow: false,
+		FilterEnabledMetadata: &matcherpb.MetadataMatcher{
+			Filter: rbacFilterName,
+			Path: []*matcherpb.MetadataMatcher_PathSegment{
+				{Segment: &matcherpb.MetadataMatcher_PathSegment_Key{Key: authzmodel.ShadowEffectivePolicyIDKey}},
+			},
+			Value: &matcherpb.ValueMatcher{MatchPattern: &matcherpb.ValueMatcher_PresentMatch{PresentMatch: true}},
+		},
+	}
+	switch {
+	case provider.GetEnvoyExtAuthzGrpc() != nil:
+		grpc := provider.GetEnvoyExtAuthzGrpc()
+		config.Services = &extauthzhttppb.ExtAuthz_GrpcService{
+			GrpcService: &corepb.GrpcService{
+				TargetSpecifier: &corepb.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &corepb.GrpcService_EnvoyGrpc{ClusterName: grpc.GetService()},
+				},
+			},
+		}
+	case provider.GetEnvoyExtAuthzHttp() != nil:
+		http := provider.GetEnvoyExtAuthzHttp()
+		config.Services = &extauthzhttppb.ExtAuthz_HttpService{
+			HttpService: &extauthzhttppb.HttpService{
+				ServerUri: &corepb.HttpUri{
+					Uri:              http.GetService(),
+					HttpUpstreamType: &corepb.HttpUri_Cluster{Cluster: http.GetService()},
+				},
+			},
+		}
+	}
+	return &httppb.HttpFilter{
+		Name:       authzmodel.ExtAuthzHTTPFilterName,
+		ConfigType: &httppb.HttpFilter_TypedConfig{TypedConfig: util.MessageToAny(config)},
+	}
+}
+
+// createExtAuthzTCPFilter is the network-filter equivalent of createExtAuthzHTTPFilter. Only a
+// gRPC provider is wired in: for an HTTP provider the filter's GrpcService is left unset.
+func createExtAuthzTCPFilter(provider *meshconfig.MeshConfig_ExtensionProvider) *tcppb.Filter {
+	config := &extauthztcppb.ExtAuthz{FailureModeAllow: false, StatPrefix: authzmodel.ExtAuthzTCPFilterStatPrefix}
+	if grpc := provider.GetEnvoyExtAuthzGrpc(); grpc != nil {
+		config.GrpcService = &corepb.GrpcService{
+			TargetSpecifier: &corepb.GrpcService_EnvoyGrpc_{
+				EnvoyGrpc: &corepb.GrpcService_EnvoyGrpc{ClusterName: grpc.GetService()},
+			},
+		}
+	}
+	return &tcppb.Filter{
+		Name:       authzmodel.ExtAuthzTCPFilterName,
+		ConfigType: &tcppb.Filter_TypedConfig{TypedConfig: util.MessageToAny(config)},
+	}
+}
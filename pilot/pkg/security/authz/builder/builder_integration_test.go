@@ -0,0 +1,104 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+
+	v1beta1 "istio.io/api/security/v1beta1"
+	"istio.io/istio/pilot/pkg/model"
+
+	rbachttppb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rbac/v2"
+	rbactcppb "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/rbac/v2"
+)
+
+// Unlike builder_test.go, this file does exercise authzmodel.New/Generate's rule-to-permission
+// translation: it drives BuildHTTP/BuildTCP end-to-end so the merge wiring in those two methods
+// - not just mergeRBAC/mergePolicySets in isolation - is covered for the cases where an enforced
+// ruleset and a shadow ruleset (from an AUDIT policy) land in the same filter.
+func denyAllowPolicy(name string, action v1beta1.AuthorizationPolicy_Action, principal string) model.AuthorizationPolicyConfig {
+	return model.AuthorizationPolicyConfig{
+		Namespace: "default",
+		Name:      name,
+		AuthorizationPolicy: &v1beta1.AuthorizationPolicy{
+			Action: action,
+			Rules: []*v1beta1.Rule{{
+				From: []*v1beta1.Rule_From{{Source: &v1beta1.Source{Principals: []string{principal}}}},
+			}},
+		},
+	}
+}
+
+func TestBuildHTTPMergesEnforceAndShadow(t *testing.T) {
+	b := &Builder{
+		denyPolicies:      []model.AuthorizationPolicyConfig{denyAllowPolicy("deny", v1beta1.AuthorizationPolicy_DENY, "cluster.local/ns/default/sa/sleep")},
+		auditDenyPolicies: []model.AuthorizationPolicyConfig{denyAllowPolicy("audit-deny", v1beta1.AuthorizationPolicy_AUDIT, "cluster.local/ns/default/sa/audit")},
+		allowPolicies:     []model.AuthorizationPolicyConfig{denyAllowPolicy("allow", v1beta1.AuthorizationPolicy_ALLOW, "cluster.local/ns/default/sa/sleep")},
+		auditAllowPolicies: []model.AuthorizationPolicyConfig{
+			denyAllowPolicy("audit-allow", v1beta1.AuthorizationPolicy_AUDIT, "cluster.local/ns/default/sa/audit"),
+		},
+	}
+
+	filters, err := b.BuildHTTP()
+	if err != nil {
+		t.Fatalf("BuildHTTP() returned error: %v", err)
+	}
+	if len(filters) != 2 {
+		t.Fatalf("BuildHTTP() returned %d filters, want 2 (merged DENY and merged ALLOW)", len(filters))
+	}
+
+	for _, f := range filters {
+		config := f.GetTypedConfig()
+		rbac := &rbachttppb.RBAC{}
+		if err := proto.Unmarshal(config.GetValue(), rbac); err != nil {
+			t.Fatalf("failed to unmarshal filter %q config: %v", f.Name, err)
+		}
+		if rbac.Rules == nil {
+			t.Errorf("filter %q: Rules is nil, want the enforced DENY/ALLOW ruleset", f.Name)
+		}
+		if rbac.ShadowRules == nil {
+			t.Errorf("filter %q: ShadowRules is nil, want the AUDIT policy's shadow ruleset", f.Name)
+		}
+	}
+}
+
+func TestBuildTCPMergesEnforceAndShadow(t *testing.T) {
+	b := &Builder{
+		denyPolicies:      []model.AuthorizationPolicyConfig{denyAllowPolicy("deny", v1beta1.AuthorizationPolicy_DENY, "cluster.local/ns/default/sa/sleep")},
+		auditDenyPolicies: []model.AuthorizationPolicyConfig{denyAllowPolicy("audit-deny", v1beta1.AuthorizationPolicy_AUDIT, "cluster.local/ns/default/sa/audit")},
+	}
+
+	filters, err := b.BuildTCP()
+	if err != nil {
+		t.Fatalf("BuildTCP() returned error: %v", err)
+	}
+	if len(filters) != 1 {
+		t.Fatalf("BuildTCP() returned %d filters, want 1 (merged DENY)", len(filters))
+	}
+
+	config := filters[0].GetTypedConfig()
+	rbac := &rbactcppb.RBAC{}
+	if err := proto.Unmarshal(config.GetValue(), rbac); err != nil {
+		t.Fatalf("failed to unmarshal filter config: %v", err)
+	}
+	if rbac.Rules == nil {
+		t.Error("Rules is nil, want the enforced DENY ruleset")
+	}
+	if rbac.ShadowRules == nil {
+		t.Error("ShadowRules is nil, want the AUDIT policy's shadow ruleset")
+	}
+}
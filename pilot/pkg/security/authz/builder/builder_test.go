@@ -0,0 +1,204 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"testing"
+
+	meshconfig "istio.io/api/mesh/v1alpha1"
+	authzmodel "istio.io/istio/pilot/pkg/security/authz/model"
+
+	rbachttppb "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/rbac/v2"
+	rbacpb "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v2"
+)
+
+// This file covers the package's own logic - merging, option translation, JSON parsing - that
+// doesn't depend on authzmodel.New/Generate's rule-to-permission translation, which this
+// package doesn't own. See builder.go and json.go for why that boundary is drawn there.
+
+func TestParseAuditCondition(t *testing.T) {
+	cases := []struct {
+		condition string
+		want      rbacpb.RBAC_AuditLoggingOptions_AuditCondition
+		wantErr   bool
+	}{
+		{"", rbacpb.RBAC_AuditLoggingOptions_NONE, false},
+		{"ON_DENY", rbacpb.RBAC_AuditLoggingOptions_ON_DENY, false},
+		{"ON_DENY_AND_ALLOW", rbacpb.RBAC_AuditLoggingOptions_ON_DENY_AND_ALLOW, false},
+		{"bogus", rbacpb.RBAC_AuditLoggingOptions_NONE, true},
+	}
+	for _, c := range cases {
+		got, err := parseAuditCondition(c.condition)
+		if (err != nil) != c.wantErr {
+			t.Errorf("parseAuditCondition(%q): err = %v, wantErr %v", c.condition, err, c.wantErr)
+			continue
+		}
+		if err == nil && got != c.want {
+			t.Errorf("parseAuditCondition(%q) = %v, want %v", c.condition, got, c.want)
+		}
+	}
+}
+
+func TestBuildAuditLoggingOptions(t *testing.T) {
+	if pb, err := buildAuditLoggingOptions(nil); err != nil || pb != nil {
+		t.Fatalf("nil options: got (%v, %v), want (nil, nil)", pb, err)
+	}
+	if pb, err := buildAuditLoggingOptions(&AuditLoggingOptions{}); err != nil || pb != nil {
+		t.Fatalf("no loggers: got (%v, %v), want (nil, nil)", pb, err)
+	}
+
+	if _, err := buildAuditLoggingOptions(&AuditLoggingOptions{
+		Loggers: []AuditLoggerConfig{{Name: "envoy.rbac.stdout_logger"}},
+	}); err == nil {
+		t.Fatal("required logger with no config: got nil error, want error")
+	}
+
+	pb, err := buildAuditLoggingOptions(&AuditLoggingOptions{
+		Loggers: []AuditLoggerConfig{{Name: "envoy.rbac.stdout_logger", IsOptional: true}},
+	})
+	if err != nil {
+		t.Fatalf("optional logger with no config: got error %v, want nil", err)
+	}
+	if len(pb.GetLoggerConfigs()) != 0 {
+		t.Fatalf("optional logger with no config should be skipped, got %d logger configs", len(pb.GetLoggerConfigs()))
+	}
+}
+
+func TestMergePolicySets(t *testing.T) {
+	if mergePolicySets() != nil {
+		t.Fatal("mergePolicySets() with no args should return nil")
+	}
+	if mergePolicySets(nil, nil) != nil {
+		t.Fatal("mergePolicySets(nil, nil) should return nil")
+	}
+
+	a := &rbacpb.RBAC{Action: rbacpb.RBAC_DENY, Policies: map[string]*rbacpb.Policy{"a": {}}}
+	b := &rbacpb.RBAC{Action: rbacpb.RBAC_DENY, Policies: map[string]*rbacpb.Policy{"b": {}}}
+	merged := mergePolicySets(a, nil, b)
+	if merged == nil || len(merged.Policies) != 2 {
+		t.Fatalf("mergePolicySets(a, nil, b) = %v, want 2 merged policies", merged)
+	}
+	if _, ok := merged.Policies["a"]; !ok {
+		t.Error("missing policy \"a\" in merged result")
+	}
+	if _, ok := merged.Policies["b"]; !ok {
+		t.Error("missing policy \"b\" in merged result")
+	}
+}
+
+func TestMergeRBAC(t *testing.T) {
+	if mergeRBAC(nil, nil) != nil {
+		t.Fatal("mergeRBAC(nil, nil) should return nil")
+	}
+
+	shadow := &rbacpb.RBAC{Action: rbacpb.RBAC_ALLOW, Policies: map[string]*rbacpb.Policy{"p": {}}}
+	// Audit-only case: no enforced rules, only a shadow ruleset. Rules must stay nil rather
+	// than being synthesized, since Envoy's RBAC filter treats rules as optional and runs in
+	// audit-only mode when it's omitted.
+	config := mergeRBAC(nil, shadow)
+	if config == nil {
+		t.Fatal("mergeRBAC(nil, shadow) = nil, want non-nil config")
+	}
+	if config.Rules != nil {
+		t.Errorf("mergeRBAC(nil, shadow).Rules = %v, want nil", config.Rules)
+	}
+	if config.ShadowRules != shadow {
+		t.Errorf("mergeRBAC(nil, shadow).ShadowRules = %v, want %v", config.ShadowRules, shadow)
+	}
+
+	enforce := &rbacpb.RBAC{Action: rbacpb.RBAC_DENY, Policies: map[string]*rbacpb.Policy{"d": {}}}
+	config = mergeRBAC(enforce, nil)
+	if config == nil || config.Rules != enforce || config.ShadowRules != nil {
+		t.Errorf("mergeRBAC(enforce, nil) = %+v, want Rules=enforce, ShadowRules=nil", config)
+	}
+}
+
+func TestAttachAuditLogging(t *testing.T) {
+	opts := &rbacpb.RBAC_AuditLoggingOptions{AuditCondition: rbacpb.RBAC_AuditLoggingOptions_ON_DENY}
+	config := &rbachttppb.RBAC{
+		Rules:       &rbacpb.RBAC{Action: rbacpb.RBAC_DENY},
+		ShadowRules: &rbacpb.RBAC{Action: rbacpb.RBAC_ALLOW},
+	}
+	attachAuditLogging(config, opts)
+	if config.Rules.AuditLoggingOptions != opts || config.ShadowRules.AuditLoggingOptions != opts {
+		t.Fatal("attachAuditLogging didn't set AuditLoggingOptions on both Rules and ShadowRules")
+	}
+
+	// Must not panic on a nil config or nil options.
+	attachAuditLogging(nil, opts)
+	attachAuditLogging(config, nil)
+}
+
+func TestApplyEffectivePolicyID(t *testing.T) {
+	config := &rbachttppb.RBAC{
+		Rules:       &rbacpb.RBAC{Action: rbacpb.RBAC_DENY},
+		ShadowRules: &rbacpb.RBAC{Action: rbacpb.RBAC_ALLOW},
+	}
+	applyEffectivePolicyID(config, &EffectivePolicyIDOption{})
+	if !config.Rules.TrackPerRuleStats || !config.ShadowRules.TrackPerRuleStats {
+		t.Fatal("applyEffectivePolicyID didn't enable TrackPerRuleStats on both Rules and ShadowRules")
+	}
+
+	untouched := &rbachttppb.RBAC{Rules: &rbacpb.RBAC{Action: rbacpb.RBAC_DENY}}
+	applyEffectivePolicyID(untouched, nil)
+	if untouched.Rules.TrackPerRuleStats {
+		t.Fatal("applyEffectivePolicyID with a nil option must leave TrackPerRuleStats unset")
+	}
+}
+
+// TestCustomRBACFilterNameIsolatesEffectivePolicyID guards the interaction documented on
+// EffectivePolicyIDOption: a CUSTOM provider's shadow gate must never share a filter name with
+// the enforced DENY/ALLOW filters, or enabling EffectivePolicyIDOption on the latter would make
+// their dynamic metadata indistinguishable from the former's shadow match.
+func TestCustomRBACFilterNameIsolatesEffectivePolicyID(t *testing.T) {
+	if got := customRBACFilterName("my-provider"); got == authzmodel.RBACHTTPFilterName {
+		t.Fatalf("customRBACFilterName(%q) = %q, must not equal the shared authzmodel.RBACHTTPFilterName", "my-provider", got)
+	}
+}
+
+func TestIsExtAuthzProvider(t *testing.T) {
+	if isExtAuthzProvider(&meshconfig.MeshConfig_ExtensionProvider{}) {
+		t.Fatal("provider with no ext_authz config should not be an ext_authz provider")
+	}
+	http := &meshconfig.MeshConfig_ExtensionProvider{
+		Provider: &meshconfig.MeshConfig_ExtensionProvider_EnvoyExtAuthzHttp{
+			EnvoyExtAuthzHttp: &meshconfig.MeshConfig_ExtensionProvider_EnvoyExternalAuthorizationHttpProvider{Service: "authz.default.svc.cluster.local"},
+		},
+	}
+	if !isExtAuthzProvider(http) {
+		t.Fatal("provider with EnvoyExtAuthzHttp should be an ext_authz provider")
+	}
+}
+
+func TestNewFromJSON(t *testing.T) {
+	builder, err := NewFromJSON(`{
+		"name": "httpbin-policy",
+		"deny_rules": [{"source": {"principals": ["cluster.local/ns/default/sa/sleep"]}}],
+		"allow_rules": [{"request": {"paths": ["/headers"]}}]
+	}`, nil)
+	if err != nil {
+		t.Fatalf("NewFromJSON returned error: %v", err)
+	}
+	if len(builder.denyPolicies) != 1 || len(builder.allowPolicies) != 1 {
+		t.Fatalf("got %d deny policies and %d allow policies, want 1 and 1", len(builder.denyPolicies), len(builder.allowPolicies))
+	}
+
+	if _, err := NewFromJSON(`not json`, nil); err == nil {
+		t.Fatal("invalid JSON: got nil error, want error")
+	}
+	if _, err := NewFromJSON(`{"name": "empty-policy"}`, nil); err == nil {
+		t.Fatal("policy with no deny_rules or allow_rules: got nil error, want error")
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+
+	v1beta1 "istio.io/api/security/v1beta1"
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/security/trustdomain"
+)
+
+// jsonPolicy is a compact, SDK-style JSON representation of an AuthorizationPolicy. It lets
+// callers (tests, or istioctl's "analyze authz --policy") feed a hand-crafted policy straight
+// into the Envoy RBAC pipeline without going through the full CRD machinery.
+type jsonPolicy struct {
+	Name       string     `json:"name"`
+	DenyRules  []jsonRule `json:"deny_rules"`
+	AllowRules []jsonRule `json:"allow_rules"`
+}
+
+type jsonRule struct {
+	Source  jsonSource  `json:"source"`
+	Request jsonRequest `json:"request"`
+}
+
+type jsonSource struct {
+	Principals []string `json:"principals"`
+}
+
+type jsonRequest struct {
+	Headers []jsonHeader `json:"headers"`
+	Paths   []string     `json:"paths"`
+}
+
+type jsonHeader struct {
+	Key    string   `json:"key"`
+	Values []string `json:"values"`
+}
+
+// NewFromJSON builds a Builder directly from a compact JSON policy instead of from CRD-sourced
+// AuthorizationPolicies. Wildcards in principals, paths and header values ("*", "foo*", "*bar")
+// follow the same convention as a CRD policy: the Rule fields below are plain strings, and it's
+// authzmodel.New/Generate - the same translation buildRBACRules() and buildCustomRules() rely on
+// for every other policy in this package - that turns them into the matching Envoy StringMatcher
+// (prefix/suffix/safe-regex), including treating a bare "*" as a safe-regex match-all rather
+// than an empty prefix Envoy would reject.
+func NewFromJSON(policyJSON string, tdBundle trustdomain.Bundle) (*Builder, error) {
+	var parsed jsonPolicy
+	if err := json.Unmarshal([]byte(policyJSON), &parsed); err != nil {
+		return nil, fmt.Errorf("invalid authorization policy JSON: %v", err)
+	}
+
+	denyPolicies := jsonRulesToPolicyConfigs(parsed.Name, "deny", parsed.DenyRules)
+	allowPolicies := jsonRulesToPolicyConfigs(parsed.Name, "allow", parsed.AllowRules)
+	if len(denyPolicies) == 0 && len(allowPolicies) == 0 {
+		return nil, fmt.Errorf("authorization policy %q has no deny_rules or allow_rules", parsed.Name)
+	}
+
+	return &Builder{
+		trustDomainBundle: tdBundle,
+		denyPolicies:      denyPolicies,
+		allowPolicies:     allowPolicies,
+	}, nil
+}
+
+// jsonRulesToPolicyConfigs wraps rules in a single model.AuthorizationPolicyConfig, named after
+// the JSON policy's own name plus suffix so a deny/allow pair doesn't collide in debug logs.
+func jsonRulesToPolicyConfigs(name, suffix string, rules []jsonRule) []model.AuthorizationPolicyConfig {
+	if len(rules) == 0 {
+		return nil
+	}
+	policy := &v1beta1.AuthorizationPolicy{Rules: make([]*v1beta1.Rule, 0, len(rules))}
+	for _, rule := range rules {
+		policy.Rules = append(policy.Rules, jsonRuleToRule(rule))
+	}
+	return []model.AuthorizationPolicyConfig{{
+		Name:                fmt.Sprintf("%s-%s", name, suffix),
+		AuthorizationPolicy: policy,
+	}}
+}
+
+func jsonRuleToRule(r jsonRule) *v1beta1.Rule {
+	rule := &v1beta1.Rule{}
+	if len(r.Source.Principals) > 0 {
+		rule.From = []*v1beta1.Rule_From{{Source: &v1beta1.Source{Principals: r.Source.Principals}}}
+	}
+	if len(r.Request.Paths) > 0 {
+		rule.To = []*v1beta1.Rule_To{{Operation: &v1beta1.Operation{Paths: r.Request.Paths}}}
+	}
+	for _, header := range r.Request.Headers {
+		rule.When = append(rule.When, &v1beta1.Condition{
+			Key:    fmt.Sprintf("request.headers[%s]", header.Key),
+			Values: header.Values,
+		})
+	}
+	return rule
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+// This file holds the filter names and stat prefixes the authz/builder package needs for the
+// CUSTOM action, AUDIT action and effective-policy-id features. It intentionally doesn't touch
+// New/Generate/MigrateTrustDomain/Model, which predate those features and live in the rest of
+// this package.
+const (
+	// RBACHTTPFilterName is the name Envoy uses to look up the HTTP RBAC filter.
+	RBACHTTPFilterName = "envoy.filters.http.rbac"
+	// RBACTCPFilterName is the name Envoy uses to look up the network RBAC filter.
+	RBACTCPFilterName = "envoy.filters.network.rbac"
+	// RBACTCPFilterStatPrefix is the stat prefix for the network RBAC filter.
+	RBACTCPFilterStatPrefix = "tcp."
+
+	// RBACShadowRulesStatPrefix is the stat prefix used whenever ShadowRules is set: by the
+	// AUDIT action, per-policy dry-run, and the CUSTOM action's ext_authz gate.
+	RBACShadowRulesStatPrefix = "istio_dry_run_"
+
+	// ExtAuthzHTTPFilterName is the name Envoy uses to look up the HTTP ext_authz filter.
+	ExtAuthzHTTPFilterName = "envoy.filters.http.ext_authz"
+	// ExtAuthzTCPFilterName is the name Envoy uses to look up the network ext_authz filter.
+	ExtAuthzTCPFilterName = "envoy.filters.network.ext_authz"
+	// ExtAuthzTCPFilterStatPrefix is the stat prefix for the network ext_authz filter.
+	ExtAuthzTCPFilterStatPrefix = "ext_authz"
+
+	// ShadowEffectivePolicyIDKey is the dynamic metadata key Envoy's RBAC engine sets, under the
+	// namespace of the RBAC filter that matched, to the name of the policy a shadow rule matched. The CUSTOM
+	// action gate uses this to decide whether a request should reach ext_authz.
+	ShadowEffectivePolicyIDKey = "shadow_effective_policy_id"
+)